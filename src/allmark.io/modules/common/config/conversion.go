@@ -0,0 +1,129 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"time"
+)
+
+// ConversionFormat describes how a single export format is produced:
+// which tool converts the rendered HTML, which arguments it is called
+// with and which file extension/MIME type the result is served as.
+type ConversionFormat struct {
+	Enabled bool
+
+	// Tool is the name of the external program that performs the
+	// conversion (e.g. "pandoc", "wkhtmltopdf"). It must be one of
+	// AllowedConverterTools and is resolved via PATH.
+	Tool string
+
+	// Arguments is the fixed argument list passed to Tool. The
+	// document is piped in on stdin and the converted result is read
+	// back from stdout, so no file paths appear here.
+	Arguments []string
+
+	// Limits caps what the Tool subprocess may consume. See
+	// ConverterSpec.
+	Limits ResourceLimits
+
+	Extension string
+	MimeType  string
+}
+
+// Conversion holds the configuration for all document export formats
+// that allmark can produce from an item's rendered HTML.
+type Conversion struct {
+	Formats map[string]ConversionFormat
+
+	// Timeout bounds how long a single conversion is allowed to run
+	// before its process is killed.
+	Timeout time.Duration
+
+	// MaxOutputBytes rejects a conversion whose output exceeds this
+	// size. Zero means DefaultConversionMaxOutputBytes.
+	MaxOutputBytes int64
+
+	// CacheDirectory is where converted documents are cached, keyed by
+	// content hash. Empty disables the cache.
+	CacheDirectory string
+
+	// CacheEntries is the maximum number of cached documents kept on
+	// disk before the least recently used ones are evicted.
+	CacheEntries int
+}
+
+// DefaultConversionTimeout is used when Conversion.Timeout is unset.
+const DefaultConversionTimeout = 30 * time.Second
+
+// DefaultConversionMaxOutputBytes is used when Conversion.MaxOutputBytes
+// is unset.
+const DefaultConversionMaxOutputBytes = 64 * 1024 * 1024
+
+// DefaultConversionCacheEntries is used when Conversion.CacheEntries is
+// unset.
+const DefaultConversionCacheEntries = 256
+
+// Format returns the configuration for the given format (e.g. "rtf",
+// "docx") and whether it is enabled.
+func (conversion Conversion) Format(format string) (ConversionFormat, bool) {
+	conversionFormat, exists := conversion.Formats[format]
+	if !exists || !conversionFormat.Enabled {
+		return ConversionFormat{}, false
+	}
+
+	return conversionFormat, true
+}
+
+// DefaultConversionFormats returns the out-of-the-box format configuration:
+// pandoc handles every format except PDF with the same
+// "-f html -t <writer>" invocation ("tex" uses pandoc's "latex" writer),
+// and PDF is produced by wkhtmltopdf; there is no pandoc entry for PDF.
+// Every format is disabled by default.
+func DefaultConversionFormats() map[string]ConversionFormat {
+	return map[string]ConversionFormat{
+		"rtf": {
+			Enabled:   false,
+			Tool:      "pandoc",
+			Arguments: []string{"-f", "html", "-t", "rtf"},
+			Extension: "rtf",
+			MimeType:  "application/rtf",
+		},
+		"docx": {
+			Enabled:   false,
+			Tool:      "pandoc",
+			Arguments: []string{"-f", "html", "-t", "docx"},
+			Extension: "docx",
+			MimeType:  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		},
+		"epub": {
+			Enabled:   false,
+			Tool:      "pandoc",
+			Arguments: []string{"-f", "html", "-t", "epub"},
+			Extension: "epub",
+			MimeType:  "application/epub+zip",
+		},
+		"odt": {
+			Enabled:   false,
+			Tool:      "pandoc",
+			Arguments: []string{"-f", "html", "-t", "odt"},
+			Extension: "odt",
+			MimeType:  "application/vnd.oasis.opendocument.text",
+		},
+		"pdf": {
+			Enabled:   false,
+			Tool:      "wkhtmltopdf",
+			Arguments: []string{"-q", "-", "-"},
+			Extension: "pdf",
+			MimeType:  "application/pdf",
+		},
+		"tex": {
+			Enabled:   false,
+			Tool:      "pandoc",
+			Arguments: []string{"-f", "html", "-t", "latex"},
+			Extension: "tex",
+			MimeType:  "application/x-tex",
+		},
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"text/template"
+)
+
+// AllowedConverterTools is the fixed set of binaries allmark is willing
+// to exec for document conversion. A configured tool that isn't in this
+// set is rejected at startup, no matter what the config asks for.
+var AllowedConverterTools = map[string]bool{
+	"pandoc":      true,
+	"wkhtmltopdf": true,
+}
+
+// ResourceLimits bounds what a converter subprocess may consume. A zero
+// value leaves the corresponding limit unset. Limits are applied via
+// prlimit and are only enforced on Linux.
+type ResourceLimits struct {
+	CPUSeconds       uint64
+	AddressSpaceByte uint64
+	MaxProcesses     uint64
+}
+
+// ConverterSpec names an allow-listed conversion tool, the fixed
+// argument template it is invoked with, and the resource limits applied
+// to it. Path is resolved once, at startup, and pinned to its absolute
+// value so the binary that actually gets allow-listed is the one that
+// runs, even if PATH changes afterwards.
+type ConverterSpec struct {
+	Name      string
+	Path      string
+	Arguments []string
+	Limits    ResourceLimits
+}
+
+// converterTemplateData is substituted into a ConverterSpec's argument
+// templates.
+type converterTemplateData struct {
+	Format string
+	Input  string
+	Output string
+}
+
+// NewConverterSpec resolves name against AllowedConverterTools and PATH,
+// returning a ConverterSpec pinned to the resolved absolute path. It
+// fails loudly if the tool isn't allow-listed or isn't installed -
+// allmark should refuse to start rather than silently run an
+// unsanctioned binary.
+func NewConverterSpec(name string, arguments []string, limits ResourceLimits) (ConverterSpec, error) {
+	if !AllowedConverterTools[name] {
+		return ConverterSpec{}, fmt.Errorf("conversion tool %q is not on the allow-list", name)
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return ConverterSpec{}, fmt.Errorf("conversion tool %q could not be found: %s", name, err.Error())
+	}
+
+	return ConverterSpec{
+		Name:      name,
+		Path:      path,
+		Arguments: arguments,
+		Limits:    limits,
+	}, nil
+}
+
+// render expands the spec's argument templates for the given format,
+// input and output placeholders.
+func (spec ConverterSpec) render(format, input, output string) ([]string, error) {
+	data := converterTemplateData{Format: format, Input: input, Output: output}
+
+	rendered := make([]string, 0, len(spec.Arguments))
+	for _, argument := range spec.Arguments {
+		tmpl, err := template.New("argument").Parse(argument)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument template %q: %s", argument, err.Error())
+		}
+
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, data); err != nil {
+			return nil, fmt.Errorf("cannot render argument template %q: %s", argument, err.Error())
+		}
+
+		rendered = append(rendered, buffer.String())
+	}
+
+	return rendered, nil
+}
+
+// Build renders the spec's argument template and returns a ready-to-run
+// command for the resolved, allow-listed binary. Input and output are
+// only meaningful to tools whose argument template references
+// "{{.Input}}"/"{{.Output}}"; tools that are piped via stdin/stdout can
+// leave them empty. On Linux the process is placed in its own process
+// group so that, once started, KillProcessGroup can take down the whole
+// tree a hung or runaway conversion may have forked; elsewhere no process
+// group is set up. Build itself does not bind any deadline; callers own
+// cancellation.
+func (spec ConverterSpec) Build(format, input, output string) (*exec.Cmd, error) {
+	arguments, err := spec.render(format, input, output)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(spec.Path, arguments...)
+	applyProcessIsolation(cmd, spec.Limits)
+
+	return cmd, nil
+}
+
+// ApplyResourceLimits applies spec.Limits to an already-started process.
+// Call it right after cmd.Start() returns, once the PID is known. Errors
+// are returned for logging but are not fatal to the conversion.
+func (spec ConverterSpec) ApplyResourceLimits(pid int) []error {
+	return applyResourceLimits(pid, spec.Limits)
+}
+
+// KillProcessGroup terminates the process group of an already-started
+// command built by Build. On Linux, because Setpgid made the process its
+// own group leader, killing -pid reaches any children it forked (e.g. a
+// PDF engine spawned by wkhtmltopdf), not just the leader itself. On
+// other platforms only the leader process is killed.
+func KillProcessGroup(cmd *exec.Cmd) error {
+	return killProcessGroup(cmd)
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package config
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitNProc is RLIMIT_NPROC, which the syscall package does not
+// export as a named constant.
+const rlimitNProc = 6
+
+// applyProcessIsolation puts cmd in its own process group so
+// killProcessGroup can take down the whole tree, not just the leader.
+func applyProcessIsolation(cmd *exec.Cmd, limits ResourceLimits) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup sends SIGKILL to the negative PID, i.e. the whole
+// process group Setpgid created. cmd.Process must be started (Setpgid
+// makes the child its own group leader, so -pid addresses the group).
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// applyResourceLimits applies limits to an already-started process via
+// prlimit. It can only run once cmd.Process exists, i.e. after Start().
+// Failures are returned but are non-fatal to the conversion - it keeps
+// running, just without that particular cap.
+func applyResourceLimits(pid int, limits ResourceLimits) []error {
+	var errs []error
+
+	if limits.CPUSeconds > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: limits.CPUSeconds, Max: limits.CPUSeconds}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if limits.AddressSpaceByte > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limits.AddressSpaceByte, Max: limits.AddressSpaceByte}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if limits.MaxProcesses > 0 {
+		if err := prlimit(pid, rlimitNProc, &syscall.Rlimit{Cur: limits.MaxProcesses, Max: limits.MaxProcesses}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// prlimit sets a resource limit via the prlimit64(2) syscall, which the
+// syscall package does not wrap directly.
+func prlimit(pid int, resource int, new *syscall.Rlimit) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(new)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package config
+
+import (
+	"os/exec"
+)
+
+// applyProcessIsolation is a no-op outside Linux.
+func applyProcessIsolation(cmd *exec.Cmd, limits ResourceLimits) {}
+
+// applyResourceLimits is a no-op outside Linux: ResourceLimits are
+// enforced via prlimit, which is Linux-specific.
+func applyResourceLimits(pid int, limits ResourceLimits) []error {
+	return nil
+}
+
+// killProcessGroup falls back to killing just the leader process:
+// without Setpgid there is no process group to target.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,40 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"allmark.io/modules/common/config"
+	"allmark.io/modules/web/server/handler"
+	"fmt"
+	"github.com/gorilla/mux"
+)
+
+// registerConversionRoutes installs one route per enabled export format
+// (e.g. "/path/to/item.docx", "/path/to/item.pdf") and wires them all up
+// to the same Convert handler, which dispatches on the matched format.
+func registerConversionRoutes(router *mux.Router, conversionConfig config.Conversion, convertHandler handler.Handler) {
+
+	convertFunc := convertHandler.Func()
+
+	for format, formatConfig := range conversionConfig.Formats {
+		if !formatConfig.Enabled {
+			continue
+		}
+
+		route := fmt.Sprintf("/{path:.*}.{format:%s}", format)
+
+		router.HandleFunc(route, convertFunc).Name(format + "-conversion").Methods("GET")
+	}
+}
+
+// registerBundleRoutes installs the ".zip" and ".tar.gz" archive
+// download routes, both served by the same Bundle handler.
+func registerBundleRoutes(router *mux.Router, bundleHandler handler.Handler) {
+
+	bundleFunc := bundleHandler.Func()
+
+	router.HandleFunc("/{path:.*}.{container:zip}", bundleFunc).Name("zip-bundle").Methods("GET")
+	router.HandleFunc("/{path:.*}.{container:tar\\.gz}", bundleFunc).Name("tar-gz-bundle").Methods("GET")
+}
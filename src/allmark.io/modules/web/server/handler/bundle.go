@@ -0,0 +1,236 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"allmark.io/modules/common/config"
+	"allmark.io/modules/common/logger"
+	"allmark.io/modules/common/route"
+	"allmark.io/modules/web/orchestrator"
+	"allmark.io/modules/web/server/header"
+	"allmark.io/modules/web/view/templates"
+	"allmark.io/modules/web/view/viewmodel"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// fileContentFetcher is the one orchestrator.FileOrchestrator method
+// Bundle needs to read an attachment's bytes for the archive. Depending
+// on the narrow interface rather than the concrete orchestrator type
+// keeps the archive-assembly logic in walk unit-testable without a real
+// orchestrator.
+type fileContentFetcher interface {
+	GetFileContents(fileRoute route.Route) ([]byte, error)
+}
+
+// bundleNamer adapts a fixed archive extension to the Converter
+// interface so getExportFilename can be reused to name the archive
+// itself after the root item.
+type bundleNamer struct {
+	extension string
+}
+
+func (namer bundleNamer) Format() string          { return namer.extension }
+func (namer bundleNamer) Extension() string       { return namer.extension }
+func (namer bundleNamer) MimeType() string        { return "" }
+func (namer bundleNamer) ETag(html string) string { return "" }
+func (namer bundleNamer) Convert(ctx context.Context, html string) ([]byte, string, error) {
+	return nil, "", fmt.Errorf("bundleNamer cannot convert content")
+}
+
+// Bundle streams an item together with all of its child items and
+// referenced files (images, PDFs, attachments) as a single archive, so
+// a whole section can be downloaded as one self-contained folder.
+//
+// The URL suffix selects the container (".zip" or ".tar.gz"); the
+// "format" query parameter (html, rtf, docx, ...) selects how item
+// bodies are rendered before being placed in the archive. Everything is
+// streamed straight to the response - no temp files, no Content-Length.
+type Bundle struct {
+	logger logger.Logger
+	config config.Config
+
+	converterModelOrchestrator *orchestrator.ConversionModelOrchestrator
+	fileOrchestrator           fileContentFetcher
+	templateProvider           templates.Provider
+	converters                 ConverterRegistry
+
+	error404Handler Handler
+}
+
+func (handler *Bundle) Func() func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		vars := mux.Vars(r)
+		path := vars["path"]
+		container := vars["container"]
+
+		requestRoute, err := route.NewFromRequest(path)
+		if err != nil {
+			handler.logger.Error("Unable to get route from request. Error: %s", err.Error())
+			return
+		}
+
+		defer r.Body.Close()
+
+		hostname := getHostnameFromRequest(r)
+		rootModel, found := handler.converterModelOrchestrator.GetConversionModel(hostname, requestRoute)
+		if !found {
+
+			// display a 404 error page
+			error404Handler := handler.error404Handler.Func()
+			error404Handler(w, r)
+			return
+		}
+
+		bodyFormat := r.URL.Query().Get("format")
+		if bodyFormat == "" {
+			bodyFormat = "html"
+		}
+
+		var converter Converter
+		if bodyFormat != "html" {
+			var converterIsConfigured bool
+			converter, converterIsConfigured = handler.converters[bodyFormat]
+			if !converterIsConfigured {
+				handler.logger.Warn("Cannot bundle item %q. Format %q is not enabled in the config.", requestRoute, bodyFormat)
+				error404Handler := handler.error404Handler.Func()
+				error404Handler(w, r)
+				return
+			}
+		}
+
+		header.Cache(w, r, header.DYNAMICCONTENT_CACHEDURATION_SECONDS)
+		header.VaryAcceptEncoding(w, r)
+
+		archiveName := getExportFilename(rootModel, bundleNamer{extension: container})
+
+		switch container {
+		case "zip":
+			header.ContentType(w, r, "application/zip")
+			w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveName))
+			handler.writeZip(r.Context(), w, hostname, rootModel, bodyFormat, converter)
+
+		case "tar.gz":
+			header.ContentType(w, r, "application/gzip")
+			w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveName))
+			handler.writeTarGz(r.Context(), w, hostname, rootModel, bodyFormat, converter)
+
+		default:
+			handler.logger.Warn("Cannot bundle item %q. Unsupported archive container %q.", requestRoute, container)
+			error404Handler := handler.error404Handler.Func()
+			error404Handler(w, r)
+		}
+
+		return
+	}
+}
+
+func (handler *Bundle) writeZip(ctx context.Context, w http.ResponseWriter, hostname string, model viewmodel.ConversionModel, bodyFormat string, converter Converter) {
+	archiveWriter := zip.NewWriter(w)
+	defer archiveWriter.Close()
+
+	handler.walk(ctx, model, "", func(entryPath string, content []byte) error {
+		entryWriter, err := archiveWriter.Create(entryPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = entryWriter.Write(content)
+		return err
+	}, hostname, bodyFormat, converter)
+}
+
+func (handler *Bundle) writeTarGz(ctx context.Context, w http.ResponseWriter, hostname string, model viewmodel.ConversionModel, bodyFormat string, converter Converter) {
+	gzipWriter := gzip.NewWriter(w)
+	defer gzipWriter.Close()
+
+	archiveWriter := tar.NewWriter(gzipWriter)
+	defer archiveWriter.Close()
+
+	handler.walk(ctx, model, "", func(entryPath string, content []byte) error {
+		if err := archiveWriter.WriteHeader(&tar.Header{
+			Name: entryPath,
+			Size: int64(len(content)),
+			Mode: 0644,
+		}); err != nil {
+			return err
+		}
+
+		_, err := archiveWriter.Write(content)
+		return err
+	}, hostname, bodyFormat, converter)
+}
+
+// walk renders the given item (and recurses into its child items),
+// writing one archive entry per item body and one per referenced file.
+func (handler *Bundle) walk(ctx context.Context, model viewmodel.ConversionModel, directory string, writeEntry func(entryPath string, content []byte) error, hostname string, bodyFormat string, converter Converter) {
+
+	itemDirectory := directory
+	if itemDirectory != "" {
+		itemDirectory = strings.TrimSuffix(itemDirectory, "/") + "/" + sanitizeEntryName(model.Title)
+	} else {
+		itemDirectory = sanitizeEntryName(model.Title)
+	}
+
+	html := handler.renderHtml(hostname, model)
+
+	body := []byte(html)
+	extension := "html"
+	if converter != nil {
+		converted, _, err := converter.Convert(ctx, html)
+		if err != nil {
+			handler.logger.Error("Could not convert item %q to %s for bundling. Error: %s", model.Route, bodyFormat, err.Error())
+		} else {
+			body = converted
+			extension = converter.Extension()
+		}
+	}
+
+	if err := writeEntry(fmt.Sprintf("%s/index.%s", itemDirectory, extension), body); err != nil {
+		handler.logger.Error("Could not write archive entry for item %q. Error: %s", model.Route, err.Error())
+		return
+	}
+
+	for _, file := range model.Files {
+		content, err := handler.fileOrchestrator.GetFileContents(file.Route)
+		if err != nil {
+			handler.logger.Warn("Could not read attachment %q for bundling. Error: %s", file.Route, err.Error())
+			continue
+		}
+
+		entryPath := fmt.Sprintf("%s/files/%s", itemDirectory, sanitizeEntryName(file.Name))
+		if err := writeEntry(entryPath, content); err != nil {
+			handler.logger.Error("Could not write archive entry for attachment %q. Error: %s", file.Route, err.Error())
+		}
+	}
+
+	for _, child := range model.Childs {
+		handler.walk(ctx, child, itemDirectory, writeEntry, hostname, bodyFormat, converter)
+	}
+}
+
+func (handler *Bundle) renderHtml(hostname string, viewModel viewmodel.ConversionModel) string {
+	return renderConversionHtml(handler.logger, handler.templateProvider, hostname, viewModel)
+}
+
+// sanitizeEntryName makes an item title safe to use as an archive path
+// component.
+func sanitizeEntryName(title string) string {
+	replacer := strings.NewReplacer("/", "-", "\\", "-", "..", "-")
+	name := strings.TrimSpace(replacer.Replace(title))
+	if name == "" {
+		return "item"
+	}
+
+	return name
+}
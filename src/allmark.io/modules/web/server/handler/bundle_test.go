@@ -0,0 +1,193 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"allmark.io/modules/common/route"
+	"allmark.io/modules/web/view/viewmodel"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// fakeFileFetcher serves fixed attachment bytes by route, standing in
+// for orchestrator.FileOrchestrator.
+type fakeFileFetcher struct {
+	contentByRoute map[string][]byte
+}
+
+func (fetcher *fakeFileFetcher) GetFileContents(fileRoute route.Route) ([]byte, error) {
+	return fetcher.contentByRoute[fileRoute.Value()], nil
+}
+
+// fakeLogger discards everything; it exists so walk has a non-nil
+// logger.Logger to call into instead of panicking on a nil interface.
+type fakeLogger struct{}
+
+func (fakeLogger) Debug(format string, v ...interface{})      {}
+func (fakeLogger) Info(format string, v ...interface{})       {}
+func (fakeLogger) Statistics(format string, v ...interface{}) {}
+func (fakeLogger) Warn(format string, v ...interface{})       {}
+func (fakeLogger) Error(format string, v ...interface{})      {}
+func (fakeLogger) Fatal(format string, v ...interface{})      {}
+
+// fakeTemplateProvider always fails to resolve a template, which drives
+// renderConversionHtml down its "no template" error path and back out
+// with an empty string. That's enough for this test: walk's archive
+// entries don't depend on the rendered body, only on a logger and
+// templateProvider that don't panic when called.
+type fakeTemplateProvider struct{}
+
+func (fakeTemplateProvider) GetSubTemplate(hostname, templateName string) (*template.Template, error) {
+	return nil, fmt.Errorf("fakeTemplateProvider has no template %q for %q", templateName, hostname)
+}
+
+// fakeResponseWriter is the minimal http.ResponseWriter the zip/tar
+// writers need: something to Write into.
+type fakeResponseWriter struct {
+	bytes.Buffer
+	header http.Header
+}
+
+func (w *fakeResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *fakeResponseWriter) WriteHeader(statusCode int) {}
+
+func mustRoute(t *testing.T, path string) route.Route {
+	t.Helper()
+
+	r, err := route.NewFromRequest(path)
+	if err != nil {
+		t.Fatalf("could not build route %q: %s", path, err)
+	}
+
+	return *r
+}
+
+// TestBundleWalkIncludesChildrenAndAttachments builds a two-level item
+// tree with one attachment and asserts the resulting archive contains
+// an entry for the root item, the child item and the attachment.
+//
+// This exercises walk's own recursion and archive-entry naming; it does
+// not exercise orchestrator.ConversionModelOrchestrator.GetConversionModel
+// itself, since that type isn't part of this handler package - whether
+// the real orchestrator actually populates Childs/Files as assumed here
+// needs to be checked against that package directly.
+func TestBundleWalkIncludesChildrenAndAttachments(t *testing.T) {
+	childRoute := mustRoute(t, "parent/child")
+	attachmentRoute := mustRoute(t, "parent/child/image.png")
+
+	child := viewmodel.ConversionModel{
+		Route: childRoute.Value(),
+		Title: "Child",
+		Level: 1,
+		Files: []viewmodel.File{
+			{Route: attachmentRoute, Name: "image.png"},
+		},
+	}
+
+	root := viewmodel.ConversionModel{
+		Route:  "parent",
+		Title:  "Parent",
+		Level:  0,
+		Childs: []viewmodel.ConversionModel{child},
+	}
+
+	bundleHandler := &Bundle{
+		logger:           fakeLogger{},
+		templateProvider: fakeTemplateProvider{},
+		fileOrchestrator: &fakeFileFetcher{
+			contentByRoute: map[string][]byte{
+				attachmentRoute.Value(): []byte("fake-image-bytes"),
+			},
+		},
+	}
+
+	responseWriter := &fakeResponseWriter{}
+	bundleHandler.writeZip(context.Background(), responseWriter, "example.com", root, "html", nil)
+
+	archiveReader, err := zip.NewReader(bytes.NewReader(responseWriter.Bytes()), int64(responseWriter.Len()))
+	if err != nil {
+		t.Fatalf("could not read produced zip archive: %s", err)
+	}
+
+	entryNames := make(map[string]bool)
+	for _, file := range archiveReader.File {
+		entryNames[file.Name] = true
+	}
+
+	if !entryNames["Parent/index.html"] {
+		t.Errorf("expected archive to contain the root item's index, got entries: %v", entryNames)
+	}
+
+	if !entryNames["Parent/Child/index.html"] {
+		t.Errorf("expected archive to contain the child item's index, got entries: %v", entryNames)
+	}
+
+	if !entryNames["Parent/Child/files/image.png"] {
+		t.Errorf("expected archive to contain the child's attachment, got entries: %v", entryNames)
+	}
+
+	for entryName := range entryNames {
+		if strings.Contains(entryName, "..") {
+			t.Errorf("expected no archive entry to contain a path traversal segment, got: %q", entryName)
+		}
+	}
+}
+
+// TestBundleWalkSanitizesAttachmentNames guards against Zip Slip: an
+// attachment whose Name contains path separators must not be able to
+// make the archive entry escape the item's directory.
+func TestBundleWalkSanitizesAttachmentNames(t *testing.T) {
+	attachmentRoute := mustRoute(t, "parent/evil")
+
+	root := viewmodel.ConversionModel{
+		Route: "parent",
+		Title: "Parent",
+		Level: 0,
+		Files: []viewmodel.File{
+			{Route: attachmentRoute, Name: "../../evil"},
+		},
+	}
+
+	bundleHandler := &Bundle{
+		logger:           fakeLogger{},
+		templateProvider: fakeTemplateProvider{},
+		fileOrchestrator: &fakeFileFetcher{
+			contentByRoute: map[string][]byte{
+				attachmentRoute.Value(): []byte("fake-bytes"),
+			},
+		},
+	}
+
+	responseWriter := &fakeResponseWriter{}
+	bundleHandler.writeZip(context.Background(), responseWriter, "example.com", root, "html", nil)
+
+	archiveReader, err := zip.NewReader(bytes.NewReader(responseWriter.Bytes()), int64(responseWriter.Len()))
+	if err != nil {
+		t.Fatalf("could not read produced zip archive: %s", err)
+	}
+
+	for _, file := range archiveReader.File {
+		// walk always writes the item's own body next to its files.
+		if file.Name == "Parent/index.html" {
+			continue
+		}
+
+		if strings.Contains(file.Name, "..") || !strings.HasPrefix(file.Name, "Parent/files/") {
+			t.Errorf("expected attachment entry to stay under Parent/files/, got: %q", file.Name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"allmark.io/modules/common/logger"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ConversionCache is an on-disk, content-addressed LRU cache for
+// converted documents. Keys are the sha256 of the format, the rendered
+// HTML and the converter tool's version, so a cache hit guarantees the
+// same tool would have produced the same bytes.
+type ConversionCache struct {
+	logger logger.Logger
+
+	directory  string
+	maxEntries int
+
+	mutex    sync.Mutex
+	accessed map[string]time.Time
+}
+
+// NewConversionCache creates a cache rooted at directory, which is
+// created if it does not yet exist. A maxEntries of 0 disables
+// eviction. Entries already on disk from a previous run are seeded into
+// the LRU accounting (ordered by each file's mtime), so eviction caps the
+// actual on-disk entry count across restarts instead of starting blind.
+func NewConversionCache(logger logger.Logger, directory string, maxEntries int) (*ConversionCache, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create conversion cache directory %q: %s", directory, err.Error())
+	}
+
+	cache := &ConversionCache{
+		logger:     logger,
+		directory:  directory,
+		maxEntries: maxEntries,
+		accessed:   make(map[string]time.Time),
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read conversion cache directory %q: %s", directory, err.Error())
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		cache.accessed[entry.Name()] = entry.ModTime()
+	}
+
+	cache.evictIfNeeded()
+
+	return cache, nil
+}
+
+// Key derives the cache key for a conversion of html to format using
+// the given converter tool version.
+func (cache *ConversionCache) Key(format, html, toolVersion string) string {
+	return conversionCacheKey(format, html, toolVersion)
+}
+
+// conversionCacheKey derives the content-addressed key for a conversion
+// of html to format by the given converter tool version. It is a plain
+// function, not a ConversionCache method, so a toolConverter can derive
+// the same key - and therefore the same ETag - whether or not a cache
+// is configured at all.
+func conversionCacheKey(format, html, toolVersion string) string {
+	hash := sha256.Sum256([]byte(format + "\x00" + html + "\x00" + toolVersion))
+	return hex.EncodeToString(hash[:])
+}
+
+func (cache *ConversionCache) path(key string) string {
+	return filepath.Join(cache.directory, key)
+}
+
+// Get returns the cached bytes for key, if present.
+func (cache *ConversionCache) Get(key string) ([]byte, bool) {
+	content, err := ioutil.ReadFile(cache.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	cache.touch(key)
+
+	return content, true
+}
+
+// Put stores content under key, evicting the least recently used entry
+// whenever the cache grows past maxEntries.
+func (cache *ConversionCache) Put(key string, content []byte) error {
+	if err := ioutil.WriteFile(cache.path(key), content, 0644); err != nil {
+		return err
+	}
+
+	cache.touch(key)
+	cache.evictIfNeeded()
+
+	return nil
+}
+
+func (cache *ConversionCache) touch(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.accessed[key] = time.Now()
+}
+
+func (cache *ConversionCache) evictIfNeeded() {
+	if cache.maxEntries <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for len(cache.accessed) > cache.maxEntries {
+		var oldestKey string
+		var oldestTime time.Time
+
+		for key, accessedAt := range cache.accessed {
+			if oldestKey == "" || accessedAt.Before(oldestTime) {
+				oldestKey = key
+				oldestTime = accessedAt
+			}
+		}
+
+		if oldestKey == "" {
+			return
+		}
+
+		if err := os.Remove(cache.path(oldestKey)); err != nil && !os.IsNotExist(err) {
+			cache.logger.Warn("Could not evict conversion cache entry %q. Error: %s", oldestKey, err.Error())
+		}
+
+		delete(cache.accessed, oldestKey)
+	}
+}
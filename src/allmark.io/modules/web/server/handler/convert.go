@@ -0,0 +1,426 @@
+// Copyright 2014 Andreas Koch. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"allmark.io/modules/common/config"
+	"allmark.io/modules/common/logger"
+	"allmark.io/modules/common/route"
+	"allmark.io/modules/web/orchestrator"
+	"allmark.io/modules/web/server/header"
+	"allmark.io/modules/web/view/templates"
+	"allmark.io/modules/web/view/viewmodel"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Converter turns a rendered HTML document into the bytes of an export
+// format (e.g. RTF, DOCX, PDF). Implementations are registered in a
+// ConverterRegistry keyed by the format's URL suffix.
+type Converter interface {
+
+	// Format returns the format identifier (e.g. "docx"), which also
+	// doubles as the URL suffix that selects it.
+	Format() string
+
+	Extension() string
+	MimeType() string
+
+	// ETag derives the ETag a conversion of html would produce, without
+	// doing any of the actual conversion work. Callers can compare it
+	// against If-None-Match and skip calling Convert entirely on a hit.
+	ETag(html string) string
+
+	// Convert renders the given HTML to the target format, returning
+	// the resulting bytes and an ETag that identifies them. Callers
+	// should pass a context carrying a deadline; a hung converter
+	// process is killed when it expires.
+	Convert(ctx context.Context, html string) (content []byte, etag string, err error)
+}
+
+// ConverterRegistry looks up a Converter by the format suffix found in
+// the request path.
+type ConverterRegistry map[string]Converter
+
+// NewConverterRegistry builds a registry of Converters, one per enabled
+// format in the supplied configuration, all sharing cache. It fails
+// loudly - returns an error instead of a half-built registry - if any
+// enabled format's tool isn't allow-listed or can't be found, since
+// that's a misconfiguration that should stop startup, not surface as a
+// confusing 404 on first use.
+func NewConverterRegistry(logger logger.Logger, conversionConfig config.Conversion, cache *ConversionCache) (ConverterRegistry, error) {
+	registry := make(ConverterRegistry)
+
+	timeout := conversionConfig.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultConversionTimeout
+	}
+
+	maxOutputBytes := conversionConfig.MaxOutputBytes
+	if maxOutputBytes <= 0 {
+		maxOutputBytes = config.DefaultConversionMaxOutputBytes
+	}
+
+	for format, formatConfig := range conversionConfig.Formats {
+		if !formatConfig.Enabled {
+			continue
+		}
+
+		spec, err := config.NewConverterSpec(formatConfig.Tool, formatConfig.Arguments, formatConfig.Limits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot enable %q conversion: %s", format, err.Error())
+		}
+
+		registry[format] = &toolConverter{
+			logger:         logger,
+			format:         format,
+			formatConfig:   formatConfig,
+			spec:           spec,
+			cache:          cache,
+			timeout:        timeout,
+			maxOutputBytes: maxOutputBytes,
+			toolVersion:    toolVersion(spec.Path),
+		}
+	}
+
+	return registry, nil
+}
+
+// toolConverter is a Converter backed by an external command-line tool
+// (pandoc, wkhtmltopdf, ...), sandboxed behind a config.ConverterSpec.
+// The tool is run as a streaming pipeline: the HTML goes in on stdin,
+// the converted document comes back on stdout, and results are cached
+// by content hash.
+type toolConverter struct {
+	logger       logger.Logger
+	format       string
+	formatConfig config.ConversionFormat
+	spec         config.ConverterSpec
+
+	cache          *ConversionCache
+	timeout        time.Duration
+	maxOutputBytes int64
+	toolVersion    string
+}
+
+func (converter *toolConverter) Format() string {
+	return converter.format
+}
+
+func (converter *toolConverter) Extension() string {
+	return converter.formatConfig.Extension
+}
+
+func (converter *toolConverter) MimeType() string {
+	return converter.formatConfig.MimeType
+}
+
+// ETag derives this conversion's ETag from its inputs alone - format,
+// html and tool version - rather than from the converted output. That
+// means a caller can compute it and answer a conditional request with a
+// 304 without ever running the external tool, whether or not a
+// ConversionCache is configured.
+func (converter *toolConverter) ETag(html string) string {
+	return conversionETag(converter.cacheKey(html))
+}
+
+func (converter *toolConverter) cacheKey(html string) string {
+	return conversionCacheKey(converter.format, html, converter.toolVersion)
+}
+
+func (converter *toolConverter) Convert(ctx context.Context, html string) ([]byte, string, error) {
+
+	etag := converter.ETag(html)
+	cacheKey := converter.cacheKey(html)
+
+	if converter.cache != nil {
+		if cached, found := converter.cache.Get(cacheKey); found {
+			return cached, etag, nil
+		}
+	}
+
+	content, err := converter.run(ctx, html)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if converter.cache != nil {
+		if err := converter.cache.Put(cacheKey, content); err != nil {
+			converter.logger.Warn("Could not cache converted %s document. Error: %s", converter.format, err.Error())
+		}
+	}
+
+	return content, etag, nil
+}
+
+// run pipes html into the converter tool's stdin and reads the
+// converted document back from its stdout, bounding both the run time
+// and the output size.
+func (converter *toolConverter) run(ctx context.Context, html string) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, converter.timeout)
+	defer cancel()
+
+	cmd, err := converter.spec.Build(converter.format, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot build %s command: %s", converter.spec.Name, err.Error())
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open stdin pipe to %s: %s", converter.spec.Name, err.Error())
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open stdout pipe from %s: %s", converter.spec.Name, err.Error())
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not start %s: %s", converter.spec.Name, err.Error())
+	}
+
+	for _, limitErr := range converter.spec.ApplyResourceLimits(cmd.Process.Pid) {
+		converter.logger.Warn("Could not apply a resource limit to %s: %s", converter.spec.Name, limitErr.Error())
+	}
+
+	// kill the whole process group - not just the leader - the moment
+	// ctx is cancelled or times out, so a converter that forked its own
+	// helper process (e.g. wkhtmltopdf's PDF engine) doesn't leak it.
+	// Outside Linux only the leader is killed.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := config.KillProcessGroup(cmd); err != nil {
+				converter.logger.Warn("Could not kill %s process group: %s", converter.spec.Name, err.Error())
+			}
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer stdin.Close()
+		io.WriteString(stdin, html)
+	}()
+
+	limitedStdout := io.LimitReader(stdout, converter.maxOutputBytes+1)
+
+	buffer := new(bytes.Buffer)
+	if _, err := io.Copy(buffer, limitedStdout); err != nil {
+		cmd.Wait()
+		return nil, fmt.Errorf("could not read %s output: %s", converter.spec.Name, err.Error())
+	}
+
+	if int64(buffer.Len()) > converter.maxOutputBytes {
+		config.KillProcessGroup(cmd)
+		cmd.Wait()
+		return nil, fmt.Errorf("%s output exceeded the %d byte limit", converter.spec.Name, converter.maxOutputBytes)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s timed out after %s", converter.spec.Name, converter.timeout)
+		}
+
+		return nil, fmt.Errorf("%s exited with an error: %s", converter.spec.Name, err.Error())
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func conversionETag(key string) string {
+	return fmt.Sprintf(`"%s"`, key)
+}
+
+// textConversionFormats lists the export formats whose converted output
+// is text, so a charset parameter on their Content-Type is meaningful.
+// Everything else (docx, odt, epub, pdf, ...) is binary and a charset
+// parameter on it would be wrong.
+var textConversionFormats = map[string]bool{
+	"html": true,
+	"rtf":  true,
+	"tex":  true,
+}
+
+// contentTypeFor builds the Content-Type header value for a converted
+// document, appending a charset only for text formats.
+func contentTypeFor(converter Converter) string {
+	if textConversionFormats[converter.Format()] {
+		return fmt.Sprintf("%s; charset=utf-8", converter.MimeType())
+	}
+
+	return converter.MimeType()
+}
+
+// toolVersion probes the resolved converter binary for its version
+// string, which becomes part of the cache key so an upgraded tool
+// invalidates stale cache entries.
+func toolVersion(resolvedPath string) string {
+	if resolvedPath == "" {
+		return ""
+	}
+
+	output, err := exec.Command(resolvedPath, "--version").Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+}
+
+// Convert is the handler behind every document export route. The target
+// format is selected by the URL suffix (e.g. ".docx", ".rtf") and
+// dispatched to the matching Converter in the registry.
+type Convert struct {
+	logger logger.Logger
+	config config.Config
+
+	converterModelOrchestrator *orchestrator.ConversionModelOrchestrator
+	templateProvider           templates.Provider
+	converters                 ConverterRegistry
+
+	error404Handler Handler
+}
+
+func (handler *Convert) Func() func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// get the path and format from the request variables
+		vars := mux.Vars(r)
+		path := vars["path"]
+		format := vars["format"]
+
+		converter, converterIsConfigured := handler.converters[format]
+		if !converterIsConfigured {
+
+			handler.logger.Warn("Cannot convert item %q. Format %q is not enabled in the config.", path, format)
+
+			// display a 404 error page
+			error404Handler := handler.error404Handler.Func()
+			error404Handler(w, r)
+			return
+
+		}
+
+		// set headers
+		header.ContentType(w, r, contentTypeFor(converter))
+		header.Cache(w, r, header.DYNAMICCONTENT_CACHEDURATION_SECONDS)
+		header.VaryAcceptEncoding(w, r)
+
+		// get the request route
+		requestRoute, err := route.NewFromRequest(path)
+		if err != nil {
+			handler.logger.Error("Unable to get route from request. Error: %s", err.Error())
+			return
+		}
+
+		// make sure the request body is closed
+		defer r.Body.Close()
+
+		// get the conversion model
+		hostname := getHostnameFromRequest(r)
+		model, found := handler.converterModelOrchestrator.GetConversionModel(hostname, requestRoute)
+		if !found {
+
+			// display a 404 error page
+			error404Handler := handler.error404Handler.Func()
+			error404Handler(w, r)
+			return
+		}
+
+		html := handler.convertToHtml(hostname, model)
+
+		// The ETag only depends on the rendered HTML, the format and the
+		// tool version, so it can be derived and compared before running
+		// the conversion at all - a conditional request is answered with
+		// a cheap 304 even when the on-disk cache is disabled.
+		etag := converter.ETag(html)
+		w.Header().Set("ETag", etag)
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		converted, _, err := converter.Convert(r.Context(), html)
+		if err != nil {
+			handler.logger.Error("Could not convert item %q to %s. Error: %s", requestRoute, format, err.Error())
+			return
+		}
+
+		w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, getExportFilename(model, converter)))
+
+		w.Write(converted)
+
+		return
+	}
+}
+
+func (handler *Convert) convertToHtml(hostname string, viewModel viewmodel.ConversionModel) string {
+	return renderConversionHtml(handler.logger, handler.templateProvider, hostname, viewModel)
+}
+
+// renderConversionHtml renders an item's conversion template to a
+// string. It is shared by every handler that needs an item's HTML body
+// before either feeding it into a converter (Convert) or placing it in
+// an archive, converted or as is (Bundle).
+func renderConversionHtml(log logger.Logger, templateProvider templates.Provider, hostname string, viewModel viewmodel.ConversionModel) string {
+
+	template, err := templateProvider.GetSubTemplate(hostname, templates.ConversionTemplateName)
+	if err != nil {
+		log.Error("No template for item of type %q.", viewModel.Type)
+		return ""
+	}
+
+	buffer := new(bytes.Buffer)
+	writer := bufio.NewWriter(buffer)
+	if err := renderTemplate(viewModel, template, writer); err != nil {
+		log.Error("%s", err)
+		return ""
+	}
+
+	writer.Flush()
+
+	return buffer.String()
+}
+
+// getExportFilename derives the Content-Disposition filename for a
+// converted item, using the converter's registered extension.
+func getExportFilename(model viewmodel.ConversionModel, converter Converter) string {
+	fallback := "document." + converter.Extension()
+
+	originalRoute, err := route.NewFromRequest(model.Route)
+	if err != nil {
+		return fallback
+	}
+
+	fileNameRoute, err := route.NewFromRequest(originalRoute.LastComponentName())
+	if err != nil {
+		return fallback
+	}
+
+	if model.Level == 0 {
+		fileNameRoute, err = route.NewFromRequest(model.Title)
+		if err != nil {
+			return fallback
+		}
+	}
+
+	return fmt.Sprintf("%s.%s", fileNameRoute.Value(), converter.Extension())
+}